@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"runtime"
+	"runtime/pprof"
 	"strings"
 	"time"
 
@@ -43,7 +47,12 @@ Starts the build loop that watches for local changes and runs
 when they're detected. A webserver is started on PORT (default
 5002).`),
 		Run: func(cmd *cobra.Command, args []string) {
-			modulir.Build(getModulirConfig(), build)
+			f := build
+			if conf.CPUProfilePath != "" || conf.MemProfilePath != "" {
+				f = profileBuild(build)
+			}
+
+			modulir.Build(getModulirConfig(), f)
 		},
 	}
 	rootCmd.AddCommand(buildCommand)
@@ -55,6 +64,13 @@ when they're detected. A webserver is started on PORT (default
 Runs the build loop one time and places the result in TARGET_DIR
 (default ./public/).`),
 		Run: func(cmd *cobra.Command, args []string) {
+			// The loop never returns, so there'd be no point at which to write
+			// out a profile.
+			if conf.CPUProfilePath != "" || conf.MemProfilePath != "" {
+				fmt.Fprintf(os.Stderr, "CPU_PROFILE_PATH and MEM_PROFILE_PATH are only supported by `build`")
+				os.Exit(1)
+			}
+
 			modulir.BuildLoop(getModulirConfig(), build)
 		},
 	}
@@ -91,6 +107,48 @@ API.`),
 		os.Exit(1)
 	}
 
+	paths := []*string{
+		&conf.CPUProfilePath,
+		&conf.LogFile,
+		&conf.MagickBin,
+		&conf.MemProfilePath,
+		&conf.MozJPEGBin,
+		&conf.PNGQuantBin,
+		&conf.TargetDir,
+	}
+	for _, p := range paths {
+		expanded, err := expandEnv(*p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error expanding conf paths: %v", err)
+			os.Exit(1)
+		}
+		*p = expanded
+	}
+
+	level, err := parseLogLevel(&conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing LOG_LEVEL: %v", err)
+		os.Exit(1)
+	}
+	logLevel = level
+
+	if conf.LogFile != "" {
+		fileLevel, err := logrus.ParseLevel(conf.LogFileLevel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing LOG_FILE_LEVEL: %v", err)
+			os.Exit(1)
+		}
+
+		f, err := os.OpenFile(conf.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening LOG_FILE: %v", err)
+			os.Exit(1)
+		}
+
+		logFile = f
+		logFileLevel = fileLevel
+	}
+
 	mimage.MagickBin = conf.MagickBin
 	mimage.MozJPEGBin = conf.MozJPEGBin
 	mimage.PNGQuantBin = conf.PNGQuantBin
@@ -115,6 +173,18 @@ API.`),
 // very many places and can probably be refactored as a local if desired.
 var conf Conf
 
+// logFile is the file that log output is written to in addition to the
+// console, if LogFile was configured. It's opened on startup.
+var logFile io.Writer
+
+// logFileLevel is the minimum level of log output to write to logFile. It's
+// resolved from Conf on startup.
+var logFileLevel = logrus.DebugLevel
+
+// logLevel is the minimum level of log output to print. It's resolved from
+// Conf on startup.
+var logLevel = logrus.InfoLevel
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -137,9 +207,16 @@ type Conf struct {
 	BlackSwanDatabaseURL string `env:"BLACK_SWAN_DATABASE_URL"`
 
 	// Concurrency is the number of build Goroutines that will be used to
-	// perform build work items.
+	// perform build work items. A value of zero or less means to use one
+	// Goroutine per available CPU.
 	Concurrency int `env:"CONCURRENCY,default=30"`
 
+	// CPUProfilePath is a path to which a pprof CPU profile of the build will
+	// be written. It's only supported by the `build` command, and `loop`
+	// refuses to start if it's set. Environment variables are expanded as in
+	// TargetDir.
+	CPUProfilePath string `env:"CPU_PROFILE_PATH"`
+
 	// Drafts is whether drafts of articles and fragments should be compiled
 	// along with their published versions.
 	//
@@ -163,17 +240,43 @@ type Conf struct {
 	// where you otherwise wouldn't have the fonts.
 	LocalFonts bool `env:"LOCAL_FONTS,default=false"`
 
+	// LogFile is a path to a file that log output will be appended to in
+	// addition to being printed to the console. Output to the file is
+	// filtered by LogFileLevel instead of LogLevel. Environment variables are
+	// expanded as in TargetDir.
+	LogFile string `env:"LOG_FILE"`
+
+	// LogFileLevel is the minimum level of log output to write to LogFile.
+	LogFileLevel string `env:"LOG_FILE_LEVEL,default=debug"`
+
+	// LogLevel is the minimum level of log output to print (e.g. "debug",
+	// "info", "warn", or "error"). When set, it takes precedence over
+	// Verbose.
+	LogLevel string `env:"LOG_LEVEL"`
+
+	// LogTimeFormat is a Go time layout used to prefix each log line with a
+	// full timestamp. When it's empty, logrus's default timestamp rendering
+	// is kept.
+	LogTimeFormat string `env:"LOG_TIME_FORMAT"`
+
 	// MailgunAPIKey is a key for Mailgun used to send email. It's required
 	// when using the `passages` command.
 	MailgunAPIKey string `env:"MAILGUN_API_KEY"`
 
 	// MagickBin is the location of the `magick` binary that ships with the
-	// ImageMagick project (an image manipulation utility).
+	// ImageMagick project (an image manipulation utility). Environment
+	// variables are expanded as in TargetDir.
 	MagickBin string `env:"MAGICK_BIN"`
 
+	// MemProfilePath is a path to which a pprof heap profile will be written
+	// when the build finishes. Like CPUProfilePath, it's only supported by the
+	// `build` command. Environment variables are expanded as in TargetDir.
+	MemProfilePath string `env:"MEM_PROFILE_PATH"`
+
 	// MozJPEGBin is the location of the `cjpeg` binary that ships with the
 	// mozjpeg project (a JPG optimizer). If configured, Sorg will put photos
-	// through an optimization pass after resizing them.
+	// through an optimization pass after resizing them. Environment variables
+	// are expanded as in TargetDir.
 	MozJPEGBin string `env:"MOZJPEG_BIN"`
 
 	// NumAtomEntries is the number of entries to put in Atom feeds.
@@ -181,7 +284,7 @@ type Conf struct {
 
 	// PNGQuantBin is the location of the `pnqquant` binary (a PNG optimizer). If
 	// configured, PNGs are passed through an optimization pass after resizing
-	// them.
+	// them. Environment variables are expanded as in TargetDir.
 	PNGQuantBin string `env:"PNGQUANT_BIN"`
 
 	// Port is the port on which to serve HTTP when looping in development.
@@ -192,12 +295,58 @@ type Conf struct {
 	SorgEnv string `env:"SORG_ENV,default=production"`
 
 	// TargetDir is the target location where the site will be built to.
+	//
+	// References to environment variables like `$HOME` or `${VAR}` are
+	// expanded, and `$$` produces a literal `$`. Referencing a variable that
+	// isn't set is an error. Expansion only applies to the sorg binary, so
+	// the Makefile's deploy targets still use the unexpanded value.
 	TargetDir string `env:"TARGET_DIR,default=./public"`
 
 	// Verbose is whether the program will print debug output as it's running.
 	Verbose bool `env:"VERBOSE,default=false"`
 }
 
+// discardFormatter is a logrus formatter that produces no output. It's used
+// when all output is written by hooks so that entries aren't formatted only
+// to be discarded.
+type discardFormatter struct{}
+
+// Format returns no output for any entry.
+func (f *discardFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// levelWriterHook is a logrus hook that writes log entries at or above a
+// minimum level to a writer. It's used to give each log destination its own
+// level.
+type levelWriterHook struct {
+	formatter logrus.Formatter
+	level     logrus.Level
+	writer    io.Writer
+}
+
+// Fire writes a formatted entry to the hook's writer.
+func (h *levelWriterHook) Fire(entry *logrus.Entry) error {
+	b, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.writer.Write(b)
+	return err
+}
+
+// Levels returns the levels that the hook fires for.
+func (h *levelWriterHook) Levels() []logrus.Level {
+	var levels []logrus.Level
+	for _, level := range logrus.AllLevels {
+		if level <= h.level {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -212,28 +361,207 @@ const (
 	sorgEnvDevelopment = "development"
 )
 
+// expandEnv expands references to environment variables like `$VAR` or
+// `${VAR}` in s. `$$` is an escape that produces a literal `$`. Unlike
+// os.ExpandEnv, referencing a variable that isn't set is an error rather than
+// an empty string so that a typo can't send a path to the filesystem root.
+func expandEnv(s string) (string, error) {
+	var undefined []string
+
+	expanded := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return val
+	})
+
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("Undefined environment variable(s) in %q: %s",
+			s, strings.Join(undefined, ", "))
+	}
+
+	return expanded, nil
+}
+
+// getConcurrency returns the configured build concurrency, resolving a
+// non-positive value to the number of available CPUs.
+func getConcurrency() int {
+	if conf.Concurrency <= 0 {
+		return runtime.NumCPU()
+	}
+
+	return conf.Concurrency
+}
+
 func getLog() modulir.LoggerInterface {
 	log := logrus.New()
 
-	if conf.Verbose {
-		log.SetLevel(logrus.DebugLevel)
-	} else {
-		log.SetLevel(logrus.InfoLevel)
+	log.SetLevel(logLevel)
+
+	formatter := &logrus.TextFormatter{}
+	if conf.LogTimeFormat != "" {
+		formatter.FullTimestamp = true
+		formatter.TimestampFormat = conf.LogTimeFormat
+	}
+	log.SetFormatter(formatter)
+
+	if logFile != nil {
+		// Output is discarded in favor of one hook per destination so that
+		// each can have its own level. logrus decides on colors based on its
+		// own output, so that decision is made here instead.
+		formatter.ForceColors = terminal.IsTerminal(int(os.Stderr.Fd()))
+		log.SetFormatter(&discardFormatter{})
+		log.SetOutput(ioutil.Discard)
+
+		log.AddHook(&levelWriterHook{
+			formatter: formatter,
+			level:     logLevel,
+			writer:    os.Stderr,
+		})
+		log.AddHook(&levelWriterHook{
+			formatter: &logrus.TextFormatter{
+				DisableColors:   true,
+				FullTimestamp:   true,
+				TimestampFormat: conf.LogTimeFormat,
+			},
+			level:  logFileLevel,
+			writer: logFile,
+		})
+
+		if logFileLevel > logLevel {
+			log.SetLevel(logFileLevel)
+		}
 	}
 
 	return log
 }
 
+// getLogColor returns whether Modulir should colorize its log output. Modulir
+// puts colors into message text rather than leaving them to the formatter, so
+// they're turned off when logging to a file to keep escape codes out of it.
+func getLogColor() bool {
+	if logFile != nil {
+		return false
+	}
+
+	return terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
 // getModulirConfig interprets Conf to produce a configuration suitable to pass
 // to a Modulir build loop.
 func getModulirConfig() *modulir.Config {
+	log := getLog()
+
+	concurrency := getConcurrency()
+	log.Infof("Using build concurrency: %v", concurrency)
+
 	return &modulir.Config{
-		Concurrency: conf.Concurrency,
-		Log:         getLog(),
-		LogColor:    terminal.IsTerminal(int(os.Stdout.Fd())),
+		Concurrency: concurrency,
+		Log:         log,
+		LogColor:    getLogColor(),
 		Port:        conf.Port,
 		SourceDir:   ".",
 		TargetDir:   conf.TargetDir,
 		Websocket:   conf.SorgEnv == sorgEnvDevelopment,
 	}
 }
+
+// parseLogLevel resolves the log level from LogLevel, falling back to
+// Verbose if it wasn't set.
+func parseLogLevel(c *Conf) (logrus.Level, error) {
+	if c.LogLevel != "" {
+		return logrus.ParseLevel(c.LogLevel)
+	}
+
+	if c.Verbose {
+		return logrus.DebugLevel, nil
+	}
+
+	return logrus.InfoLevel, nil
+}
+
+// profileBuild wraps a build function so that it runs under startProfiling.
+// Profiles are written before the build function returns, which means they're
+// still written if the build fails and Modulir exits.
+func profileBuild(f func(*modulir.Context) []error) func(*modulir.Context) []error {
+	return func(c *modulir.Context) []error {
+		stopProfiling, err := startProfiling()
+		if err != nil {
+			return []error{err}
+		}
+
+		errors := f(c)
+
+		// Modulir waits on the last phase only after the build function
+		// returns, which would leave its jobs out of the profile, so wait on
+		// it here instead. Wait returns every job error from the build, so
+		// drop the job errors that f may have returned already to avoid
+		// reporting them twice.
+		var allErrors []error
+		for _, err := range errors {
+			if _, ok := err.(*modulir.Job); !ok {
+				allErrors = append(allErrors, err)
+			}
+		}
+		allErrors = append(allErrors, c.Wait()...)
+
+		if err := stopProfiling(); err != nil {
+			allErrors = append(allErrors, err)
+		}
+
+		return allErrors
+	}
+}
+
+// startProfiling starts a CPU profile if CPUProfilePath is configured. The
+// returned function stops it, and writes a heap profile if MemProfilePath is
+// configured.
+func startProfiling() (func() error, error) {
+	var cpuFile *os.File
+
+	if conf.CPUProfilePath != "" {
+		f, err := os.Create(conf.CPUProfilePath)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating CPU profile: %v", err)
+		}
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Error starting CPU profile: %v", err)
+		}
+
+		cpuFile = f
+	}
+
+	return func() error {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+
+			if err := cpuFile.Close(); err != nil {
+				return fmt.Errorf("Error closing CPU profile: %v", err)
+			}
+		}
+
+		if conf.MemProfilePath != "" {
+			f, err := os.Create(conf.MemProfilePath)
+			if err != nil {
+				return fmt.Errorf("Error creating heap profile: %v", err)
+			}
+			defer f.Close()
+
+			// Collect garbage so that the profile reflects live objects.
+			runtime.GC()
+
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				return fmt.Errorf("Error writing heap profile: %v", err)
+			}
+		}
+
+		return nil
+	}, nil
+}
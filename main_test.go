@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/brandur/modulir"
+	"github.com/sirupsen/logrus"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestGetConcurrency(t *testing.T) {
+	defer func(concurrency int) { conf.Concurrency = concurrency }(conf.Concurrency)
+
+	conf.Concurrency = 10
+	assert.Equal(t, 10, getConcurrency())
+
+	conf.Concurrency = 0
+	assert.Equal(t, runtime.NumCPU(), getConcurrency())
+
+	conf.Concurrency = -1
+	assert.Equal(t, runtime.NumCPU(), getConcurrency())
+}
+
+func TestParseLogLevel(t *testing.T) {
+	testCases := []struct {
+		conf  Conf
+		level logrus.Level
+	}{
+		{Conf{}, logrus.InfoLevel},
+		{Conf{Verbose: true}, logrus.DebugLevel},
+		{Conf{LogLevel: "warn"}, logrus.WarnLevel},
+		{Conf{LogLevel: "error", Verbose: true}, logrus.ErrorLevel},
+	}
+	for _, tc := range testCases {
+		level, err := parseLogLevel(&tc.conf)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.level, level)
+	}
+
+	_, err := parseLogLevel(&Conf{LogLevel: "loud"})
+	assert.Error(t, err)
+}
+
+func TestGetLogTimeFormat(t *testing.T) {
+	defer func(format string) { conf.LogTimeFormat = format }(conf.LogTimeFormat)
+
+	conf.LogTimeFormat = ""
+	formatter := getLog().(*logrus.Logger).Formatter.(*logrus.TextFormatter)
+	assert.False(t, formatter.FullTimestamp)
+	assert.Equal(t, "", formatter.TimestampFormat)
+
+	conf.LogTimeFormat = time.RFC3339
+	formatter = getLog().(*logrus.Logger).Formatter.(*logrus.TextFormatter)
+	assert.True(t, formatter.FullTimestamp)
+	assert.Equal(t, time.RFC3339, formatter.TimestampFormat)
+}
+
+func TestStartProfiling(t *testing.T) {
+	defer func(cpuPath, memPath string) {
+		conf.CPUProfilePath = cpuPath
+		conf.MemProfilePath = memPath
+	}(conf.CPUProfilePath, conf.MemProfilePath)
+
+	dir, err := ioutil.TempDir("", "sorg-profile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf.CPUProfilePath = path.Join(dir, "cpu.prof")
+	conf.MemProfilePath = path.Join(dir, "mem.prof")
+
+	stopProfiling, err := startProfiling()
+	assert.NoError(t, err)
+	assert.NoError(t, stopProfiling())
+
+	for _, p := range []string{conf.CPUProfilePath, conf.MemProfilePath} {
+		info, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.NotZero(t, info.Size())
+	}
+}
+
+func TestLevelWriterHook(t *testing.T) {
+	var console, file bytes.Buffer
+
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	log.SetLevel(logrus.DebugLevel)
+	log.AddHook(&levelWriterHook{
+		formatter: &logrus.TextFormatter{DisableColors: true},
+		level:     logrus.InfoLevel,
+		writer:    &console,
+	})
+	log.AddHook(&levelWriterHook{
+		formatter: &logrus.TextFormatter{DisableColors: true},
+		level:     logrus.DebugLevel,
+		writer:    &file,
+	})
+
+	log.Debugf("debug message")
+	log.Infof("info message")
+
+	assert.NotContains(t, console.String(), "debug message")
+	assert.Contains(t, console.String(), "info message")
+	assert.Contains(t, file.String(), "debug message")
+	assert.Contains(t, file.String(), "info message")
+}
+
+func TestExpandEnv(t *testing.T) {
+	assert.NoError(t, os.Setenv("SORG_TEST_DIR", "/tmp/sorg"))
+	defer os.Unsetenv("SORG_TEST_DIR")
+	assert.NoError(t, os.Unsetenv("SORG_TEST_UNSET"))
+
+	testCases := []struct {
+		in       string
+		expanded string
+		err      bool
+	}{
+		{"./public", "./public", false},
+		{"$SORG_TEST_DIR/public", "/tmp/sorg/public", false},
+		{"${SORG_TEST_DIR}/public", "/tmp/sorg/public", false},
+		{"./out$$1", "./out$1", false},
+		{"$SORG_TEST_UNSET/public", "", true},
+		{"./out$1", "", true},
+	}
+	for _, tc := range testCases {
+		expanded, err := expandEnv(tc.in)
+		if tc.err {
+			assert.Error(t, err, tc.in)
+		} else {
+			assert.NoError(t, err, tc.in)
+			assert.Equal(t, tc.expanded, expanded, tc.in)
+		}
+	}
+}
+
+func TestProfileBuild(t *testing.T) {
+	defer func(cpuPath, memPath string) {
+		conf.CPUProfilePath = cpuPath
+		conf.MemProfilePath = memPath
+	}(conf.CPUProfilePath, conf.MemProfilePath)
+
+	dir, err := ioutil.TempDir("", "sorg-profile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf.CPUProfilePath = path.Join(dir, "cpu.prof")
+	conf.MemProfilePath = path.Join(dir, "mem.prof")
+
+	log := &modulir.Logger{Level: modulir.LevelInfo}
+	c := modulir.NewContext(&modulir.Args{Log: log, Pool: modulir.NewPool(log, 2)})
+	c.StartRound()
+	defer c.Pool.Wait()
+
+	var lastPhaseRan bool
+	errors := profileBuild(func(c *modulir.Context) []error {
+		c.AddJob("failing job", func() (bool, error) {
+			return true, fmt.Errorf("job error")
+		})
+
+		// Returned the same way as build does when a phase fails.
+		jobErrors := c.Wait()
+
+		c.AddJob("last phase", func() (bool, error) {
+			lastPhaseRan = true
+			return true, nil
+		})
+
+		return jobErrors
+	})(c)
+
+	// The last phase should have finished before the profiles were written,
+	// and the job error should only be reported once.
+	assert.True(t, lastPhaseRan)
+	assert.Len(t, errors, 1)
+
+	for _, p := range []string{conf.CPUProfilePath, conf.MemProfilePath} {
+		info, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.NotZero(t, info.Size())
+	}
+}
+
+func TestGetLogWithLogFile(t *testing.T) {
+	defer func(file io.Writer, fileLevel, level logrus.Level, format string) {
+		logFile = file
+		logFileLevel = fileLevel
+		logLevel = level
+		conf.LogTimeFormat = format
+	}(logFile, logFileLevel, logLevel, conf.LogTimeFormat)
+
+	var file bytes.Buffer
+	logFile = &file
+	logFileLevel = logrus.DebugLevel
+	logLevel = logrus.ErrorLevel
+	// A layout without any time elements renders as itself.
+	conf.LogTimeFormat = "custom-layout"
+
+	log := getLog().(*logrus.Logger)
+
+	// The logger itself only feeds the hooks, so it shouldn't format
+	// anything, and its level is lowered to the file's.
+	assert.IsType(t, &discardFormatter{}, log.Formatter)
+	assert.Equal(t, logrus.DebugLevel, log.Level)
+
+	log.Debugf("debug message")
+	assert.Contains(t, file.String(), "debug message")
+	assert.Contains(t, file.String(), `time=custom-layout`)
+
+	// Modulir's own colors go into message text, so they're disabled.
+	assert.False(t, getLogColor())
+}